@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"sync"
+
+	"github.com/MixinNetwork/kraken/engine/logx"
+	"github.com/pion/webrtc/v2"
+)
+
+// codecInfo describes a registered payload type's clock rate and media
+// kind, so a Peer can build a trackCtx for whatever track a publisher
+// sends instead of assuming Opus.
+type codecInfo struct {
+	clockRate uint32
+	kind      webrtc.RTPCodecType
+}
+
+// Engine owns the codecs this deployment accepts from publishers, on top
+// of whatever room/session state the rest of the package manages.
+type Engine struct {
+	// Logger is the root structured logger every Peer's own logger is
+	// derived from via With(). Left nil, a fresh context-less Logger is
+	// used instead.
+	Logger *logx.Logger
+
+	codecsLock sync.RWMutex
+	codecs     map[uint8]codecInfo
+}
+
+// logger returns engine.Logger, falling back to a context-less Logger so
+// BuildPeer never needs to nil-check it.
+func (engine *Engine) logger() *logx.Logger {
+	if engine.Logger != nil {
+		return engine.Logger
+	}
+	return logx.New()
+}
+
+// RegisterCodec enables payloadType for incoming tracks, so operators can
+// turn on VP8, H264, G722, etc. alongside or instead of Opus.
+func (engine *Engine) RegisterCodec(payloadType uint8, clockRate uint32, kind webrtc.RTPCodecType) {
+	engine.codecsLock.Lock()
+	defer engine.codecsLock.Unlock()
+	if engine.codecs == nil {
+		engine.codecs = make(map[uint8]codecInfo)
+	}
+	engine.codecs[payloadType] = codecInfo{clockRate: clockRate, kind: kind}
+}
+
+// codec reports the registered clock rate and kind for payloadType. Until
+// an operator registers anything, it falls back to the historical
+// Opus-only behavior so existing deployments keep working unchanged.
+func (engine *Engine) codec(payloadType uint8) (codecInfo, bool) {
+	engine.codecsLock.RLock()
+	defer engine.codecsLock.RUnlock()
+	if ci, ok := engine.codecs[payloadType]; ok {
+		return ci, true
+	}
+	if engine.codecs == nil && payloadType == webrtc.DefaultPayloadTypeOpus {
+		return codecInfo{clockRate: rtpClockRate, kind: webrtc.RTPCodecTypeAudio}, true
+	}
+	return codecInfo{}, false
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/MixinNetwork/kraken/engine/logx"
+	"github.com/pion/rtp"
+)
+
+const (
+	// subscriberQueueSize bounds how many packets a subscriber can lag
+	// behind the publisher before playout starts dropping its oldest
+	// buffered packet instead of growing without limit.
+	subscriberQueueSize = 256
+	// subscriberDropLogInterval caps how often a single lagging
+	// subscriber can spam the log with drop warnings.
+	subscriberDropLogInterval = time.Second
+)
+
+// subscriberQueue decouples one subscriber's send pace from the publisher's
+// reader goroutine and from every other subscriber: a slow consumer drops
+// its own oldest buffered packet instead of backing up the shared pipeline.
+type subscriberQueue struct {
+	sender *Sender
+	log    *logx.Logger
+	ring   chan *rtp.Packet
+
+	sent        uint64
+	dropped     uint64
+	lastDropLog int64 // unix nanos, atomic
+}
+
+func newSubscriberQueue(sender *Sender, log *logx.Logger) *subscriberQueue {
+	return &subscriberQueue{sender: sender, log: log, ring: make(chan *rtp.Packet, subscriberQueueSize)}
+}
+
+// push enqueues pkt, dropping the oldest buffered packet first if the
+// subscriber's queue is full.
+func (q *subscriberQueue) push(pkt *rtp.Packet) {
+	select {
+	case q.ring <- pkt:
+		return
+	default:
+	}
+
+	select {
+	case <-q.ring:
+		atomic.AddUint64(&q.dropped, 1)
+	default:
+	}
+	select {
+	case q.ring <- pkt:
+	default:
+	}
+	q.logDrop()
+}
+
+func (q *subscriberQueue) logDrop() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&q.lastDropLog)
+	if time.Duration(now-last) < subscriberDropLogInterval {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&q.lastDropLog, last, now) {
+		q.log.Warn("Subscriber queue full, dropping oldest packet")
+	}
+}
+
+// AddSubscriber registers sender to receive every packet played out on the
+// track identified by ssrc, through its own bounded queue and writer
+// goroutine, and returns false if the track isn't known.
+func (peer *Peer) AddSubscriber(ssrc uint32, uid string, sender *Sender) bool {
+	peer.RLock()
+	tc := peer.tracks[ssrc]
+	peer.RUnlock()
+	if tc == nil {
+		return false
+	}
+
+	q := newSubscriberQueue(sender, tc.log.With("uid", uid))
+	tc.subsLock.Lock()
+	old := tc.subs[uid]
+	tc.subs[uid] = q
+	tc.subsLock.Unlock()
+	if old != nil {
+		close(old.ring)
+	}
+
+	go peer.writeSubscriber(q)
+	return true
+}
+
+// RemoveSubscriber stops fanning packets out to uid on the track identified
+// by ssrc and lets its writer goroutine drain and exit.
+func (peer *Peer) RemoveSubscriber(ssrc uint32, uid string) {
+	peer.RLock()
+	tc := peer.tracks[ssrc]
+	peer.RUnlock()
+	if tc == nil {
+		return
+	}
+
+	tc.subsLock.Lock()
+	q := tc.subs[uid]
+	delete(tc.subs, uid)
+	tc.subsLock.Unlock()
+	if q != nil {
+		close(q.ring)
+	}
+}
+
+// fanout pushes pkt to every subscriber currently registered on tc.
+func (tc *trackCtx) fanout(pkt *rtp.Packet) {
+	tc.subsLock.RLock()
+	defer tc.subsLock.RUnlock()
+	for _, q := range tc.subs {
+		q.push(pkt)
+	}
+}
+
+// writeSubscriber drains q, sending each packet as it's received, and exits
+// once q is closed and drained.
+func (peer *Peer) writeSubscriber(q *subscriberQueue) {
+	for pkt := range q.ring {
+		q.send(pkt)
+	}
+}
+
+func (q *subscriberQueue) send(pkt *rtp.Packet) {
+	if _, err := q.sender.rtp.SendRTP(&pkt.Header, pkt.Payload); err != nil {
+		q.log.Warn("Subscriber SendRTP failed", "error", err)
+		return
+	}
+	atomic.AddUint64(&q.sent, 1)
+}
+
+// SubscriberStats is a snapshot of one subscriber's fanout health on one
+// published track.
+type SubscriberStats struct {
+	UID     string
+	SSRC    uint32
+	Sent    uint64
+	Dropped uint64
+	RTT     time.Duration
+	Bitrate int64
+}
+
+// Stats reports per-subscriber fanout metrics across every track this peer
+// publishes.
+func (peer *Peer) Stats() []SubscriberStats {
+	peer.RLock()
+	tracks := make([]*trackCtx, 0, len(peer.tracks))
+	for _, tc := range peer.tracks {
+		tracks = append(tracks, tc)
+	}
+	peer.RUnlock()
+
+	var stats []SubscriberStats
+	for _, tc := range tracks {
+		tc.subsLock.RLock()
+		for uid, q := range tc.subs {
+			stats = append(stats, SubscriberStats{
+				UID:     uid,
+				SSRC:    tc.ssrc,
+				Sent:    atomic.LoadUint64(&q.sent),
+				Dropped: atomic.LoadUint64(&q.dropped),
+				RTT:     q.sender.stats.rtt(),
+				Bitrate: tc.rate.Rate(),
+			})
+		}
+		tc.subsLock.RUnlock()
+	}
+	return stats
+}
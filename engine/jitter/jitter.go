@@ -0,0 +1,212 @@
+// Package jitter implements a reorder/dedup buffer with RFC 3550 style
+// inter-arrival jitter estimation and adaptive playout delay, so that a
+// transport can absorb network reordering without either dropping
+// legitimate late packets or adding unbounded latency.
+package jitter
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// windowSize bounds how many packets, in order or not, we hold at once.
+const windowSize = 512
+
+type slot struct {
+	pkt      *rtp.Packet
+	deadline uint32
+}
+
+// Buffer reorders and deduplicates an RTP stream keyed by (timestamp, seq),
+// estimates inter-arrival jitter per RFC 3550 6.4.1, and releases packets
+// once their adaptive playout deadline has elapsed.
+type Buffer struct {
+	mu sync.Mutex
+
+	clockRate uint32
+	window    map[uint16]*slot
+
+	haveLast   bool
+	lastSeqSet bool
+	lastSeq    uint16
+	lastArr    uint32 // R_i, arrival time of the previous packet, RTP units
+	lastSent   uint32 // S_i, RTP timestamp of the previous packet
+	jitter     float64
+	totalSent  uint32
+	totalLost  uint32
+}
+
+// New returns a Buffer for a stream sampled at clockRate Hz.
+func New(clockRate uint32) *Buffer {
+	return &Buffer{clockRate: clockRate, window: make(map[uint16]*slot)}
+}
+
+// seqAfter reports whether a is strictly after b with wraparound-safe
+// comparison, per RFC 1982 serial number arithmetic.
+func seqAfter(a, b uint16) bool {
+	return int16(a-b) > 0
+}
+
+// Jitter returns the current smoothed inter-arrival jitter estimate, in
+// RTP timestamp units, as defined by RFC 3550 6.4.1.
+func (b *Buffer) Jitter() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.jitter
+}
+
+// minDelay and maxDelay bound the adaptive playout delay, scaled to the
+// stream's clock rate, so a very quiet link doesn't collapse to zero
+// latency and a very noisy one doesn't grow the buffer without limit.
+func (b *Buffer) minDelay() uint32 { return b.clockRate / 250 } // 4ms
+func (b *Buffer) maxDelay() uint32 { return b.clockRate / 4 }   // 250ms
+
+// TargetDelay returns the adaptive playout delay derived from the current
+// jitter estimate, clamped to [minDelay, maxDelay].
+func (b *Buffer) TargetDelay() uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.targetDelay()
+}
+
+func (b *Buffer) targetDelay() uint32 {
+	delay := uint32(4 * b.jitter)
+	if delay < b.minDelay() {
+		return b.minDelay()
+	}
+	if delay > b.maxDelay() {
+		return b.maxDelay()
+	}
+	return delay
+}
+
+// LossFraction returns the fraction of packets lost since the last call,
+// scaled to [0,256) as in RTCP receiver reports, and resets the counters.
+func (b *Buffer) LossFraction() uint8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := b.totalSent + b.totalLost
+	if total == 0 {
+		return 0
+	}
+	frac := b.totalLost * 256 / total
+	if frac > 255 {
+		frac = 255
+	}
+	b.totalSent, b.totalLost = 0, 0
+	return uint8(frac)
+}
+
+// updateJitter applies the RFC 3550 recursive estimator:
+//
+//	D(i,j) = (R_j - R_i) - (S_j - S_i)
+//	J      = J + (|D(i-1,i)| - J) / 16
+func (b *Buffer) updateJitter(arrival, sent uint32) {
+	if !b.haveLast {
+		b.haveLast = true
+		b.lastArr, b.lastSent = arrival, sent
+		return
+	}
+	d := int64(arrival) - int64(b.lastArr) - (int64(sent) - int64(b.lastSent))
+	if d < 0 {
+		d = -d
+	}
+	b.jitter += (float64(d) - b.jitter) / 16
+	b.lastArr, b.lastSent = arrival, sent
+}
+
+// Push admits pkt received at RTP-timestamp-equivalent arrival time, and
+// returns the in-order, deduplicated packets (if any) whose playout
+// deadline has already elapsed at now. Packets are released in sequence
+// order; true duplicates of an already-buffered (timestamp, seq) pair are
+// dropped silently.
+func (b *Buffer) Push(pkt *rtp.Packet, arrival, now uint32) []*rtp.Packet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.updateJitter(arrival, pkt.Timestamp)
+
+	if old, ok := b.window[pkt.SequenceNumber]; ok {
+		if old.pkt.Timestamp == pkt.Timestamp {
+			return nil
+		}
+	}
+
+	delay := b.targetDelay()
+
+	if b.haveSeq() && seqAfter(b.lastSeq, pkt.SequenceNumber) {
+		b.totalLost++
+		return nil // arrived too late, already played out
+	}
+
+	b.window[pkt.SequenceNumber] = &slot{pkt: pkt, deadline: arrival + delay}
+	b.totalSent++
+	if len(b.window) > windowSize {
+		b.evictOldest()
+	}
+
+	return b.drain(now)
+}
+
+func (b *Buffer) haveSeq() bool {
+	return b.lastSeqSet
+}
+
+// drain pops every buffered packet, in ascending sequence order, whose
+// deadline is at or before now.
+func (b *Buffer) drain(now uint32) []*rtp.Packet {
+	var out []*rtp.Packet
+	for {
+		next, ok := b.nextReady(now)
+		if !ok {
+			break
+		}
+		out = append(out, next.pkt)
+		b.lastSeq = next.pkt.SequenceNumber
+		b.lastSeqSet = true
+		delete(b.window, next.pkt.SequenceNumber)
+	}
+	return out
+}
+
+// nextReady returns the lowest-sequence buffered packet whose playout
+// deadline has elapsed at now. A packet that fills a gap and is still
+// within its deadline stays buffered like any other, so the target delay
+// is honored on the common in-order path and not just during reordering.
+func (b *Buffer) nextReady(now uint32) (*slot, bool) {
+	var best *slot
+	for seq, s := range b.window {
+		if int32(now-s.deadline) < 0 {
+			continue
+		}
+		if best == nil || seqAfter(best.pkt.SequenceNumber, seq) {
+			best = s
+		}
+	}
+	return best, best != nil
+}
+
+// Drain releases any buffered packets whose deadline has elapsed at now,
+// without admitting a new packet. Call this periodically so a stream isn't
+// stalled merely because no new packet has arrived to trigger a Push.
+func (b *Buffer) Drain(now uint32) []*rtp.Packet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.drain(now)
+}
+
+func (b *Buffer) evictOldest() {
+	var oldest uint16
+	var found bool
+	for seq := range b.window {
+		if !found || seqAfter(oldest, seq) {
+			oldest, found = seq, true
+		}
+	}
+	if found {
+		delete(b.window, oldest)
+		b.totalLost++
+	}
+}
@@ -0,0 +1,27 @@
+package jitter
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// TestUpdateJitterReordered guards against the inter-arrival deltas being
+// subtracted as uint32 before going negative: a packet whose RTP timestamp
+// is lower than the previous one (exactly what reordering produces) must
+// not make the jitter estimate explode.
+func TestUpdateJitterReordered(t *testing.T) {
+	b := New(48000)
+
+	push := func(seq uint16, ts, arrival uint32) {
+		b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}}, arrival, arrival)
+	}
+
+	push(1, 1000, 1000)
+	push(3, 1003, 1003)
+	push(2, 1002, 1004)
+
+	if b.jitter > float64(b.minDelay()) {
+		t.Fatalf("jitter exploded on a reordered packet: got %v", b.jitter)
+	}
+}
@@ -0,0 +1,73 @@
+// Package logx is a small structured-logging layer over the process-wide
+// mixin/logger package. It lets call-sites attach a fixed set of context
+// fields (rid, uid, cid, ssrc, seq, ...) once and have every subsequent
+// log line carry them, instead of formatting an id string by hand at each
+// call-site and hoping downstream aggregators can regex it back apart.
+package logx
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger carries a fixed context and renders leveled log lines through the
+// process-wide mixin/logger backend.
+type Logger struct {
+	ctx []field
+}
+
+// New returns a Logger with no context fields.
+func New() *Logger {
+	return &Logger{}
+}
+
+// With returns a child Logger carrying l's context plus the given
+// alternating key/value pairs.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := &Logger{ctx: make([]field, len(l.ctx), len(l.ctx)+len(kv)/2)}
+	copy(child.ctx, l.ctx)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, _ := kv[i].(string)
+		child.ctx = append(child.ctx, field{key: key, value: kv[i+1]})
+	}
+	return child
+}
+
+func (l *Logger) format(msg string, kv []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range l.ctx {
+		fmt.Fprintf(&b, " %s=%v", f.key, f.value)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	return b.String()
+}
+
+// Trace logs high-frequency, per-packet events (NACKs, receiver reports).
+func (l *Logger) Trace(msg string, kv ...interface{}) {
+	logger.Verbosef("TRACE %s\n", l.format(msg, kv))
+}
+
+// Debug logs state transitions (signaling/connection/ICE state changes).
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	logger.Debugf("DEBUG %s\n", l.format(msg, kv))
+}
+
+// Info logs connect/close lifecycle events.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	logger.Printf("INFO %s\n", l.format(msg, kv))
+}
+
+// Warn logs timeouts and other recoverable failures.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	logger.Printf("WARN %s\n", l.format(msg, kv))
+}
@@ -0,0 +1,48 @@
+package packetcache
+
+import "sync"
+
+// Estimator maintains an exponentially-weighted estimate of a stream's
+// bitrate, sampled on every packet and smoothed with a shift-based filter
+// of gain 1/8, the same form RFC 3550 6.4.1 uses for jitter with gain 1/16.
+type Estimator struct {
+	mu        sync.Mutex
+	clockRate uint32
+	rate      int64 // bytes/sec, smoothed
+	lastTick  uint32
+	have      bool
+}
+
+// NewEstimator returns an Estimator for a stream sampled at clockRate Hz.
+func NewEstimator(clockRate uint32) *Estimator {
+	return &Estimator{clockRate: clockRate}
+}
+
+// Update folds in a packet of the given size arriving at tick, an RTP
+// clock reading from the same monotonic source on every call:
+//
+//	rate = rate + (bytes*clockRate/dt - rate) >> 3
+func (e *Estimator) Update(bytes int, tick uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.have {
+		e.have = true
+		e.lastTick = tick
+		return
+	}
+	dt := tick - e.lastTick
+	e.lastTick = tick
+	if dt == 0 {
+		return
+	}
+	sample := int64(bytes) * int64(e.clockRate) / int64(dt)
+	e.rate += (sample - e.rate) >> 3
+}
+
+// Rate returns the current smoothed bitrate estimate in bytes/sec.
+func (e *Estimator) Rate() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rate
+}
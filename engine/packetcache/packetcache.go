@@ -0,0 +1,88 @@
+// Package packetcache holds the most recently forwarded RTP packets of a
+// publisher's track so that a subscriber's NACK can be served without
+// re-requesting from the publisher, and tracks an exponentially-weighted
+// estimate of the stream's bitrate.
+package packetcache
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+const maxPacketLength = 1500
+
+type entry struct {
+	seq    uint16
+	length uint16
+	valid  bool
+	buf    [maxPacketLength]byte
+}
+
+// Cache is a fixed-size circular buffer of raw RTP packets for a single
+// SSRC, indexed by seq & (N-1). Storing a new packet silently overwrites
+// whatever used to occupy that slot, so Get reports a miss once a packet
+// has been evicted rather than returning stale data.
+type Cache struct {
+	mu      sync.Mutex
+	entries []entry
+	mask    uint16
+}
+
+// New returns a Cache holding the last size packets, rounded up to the
+// next power of two.
+func New(size int) *Cache {
+	n := 1
+	for n < size {
+		n *= 2
+	}
+	return &Cache{entries: make([]entry, n), mask: uint16(n - 1)}
+}
+
+// Store records pkt so a later Get can serve it as a NACK resend.
+func (c *Cache) Store(pkt *rtp.Packet) error {
+	buf, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	if len(buf) > maxPacketLength {
+		return fmt.Errorf("packetcache: packet %d too large to cache (%d > %d)", pkt.SequenceNumber, len(buf), maxPacketLength)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &c.entries[pkt.SequenceNumber&c.mask]
+	e.seq = pkt.SequenceNumber
+	e.length = uint16(copy(e.buf[:], buf))
+	e.valid = true
+	return nil
+}
+
+// Get copies the cached packet for seq into buf and returns its length, or
+// 0 if the slot is empty or now holds a different, more recent sequence
+// number.
+func (c *Cache) Get(seq uint16, buf []byte) uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &c.entries[seq&c.mask]
+	if !e.valid || e.seq != seq {
+		return 0
+	}
+	return uint16(copy(buf, e.buf[:e.length]))
+}
+
+// GetPacket is a convenience wrapper around Get that unmarshals the cached
+// bytes back into an *rtp.Packet, for callers that resend through an API
+// expecting a parsed packet rather than raw bytes.
+func (c *Cache) GetPacket(seq uint16) *rtp.Packet {
+	var buf [maxPacketLength]byte
+	n := c.Get(seq, buf[:])
+	if n == 0 {
+		return nil
+	}
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(buf[:n]); err != nil {
+		return nil
+	}
+	return pkt
+}
@@ -6,7 +6,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/kraken/engine/logx"
 	"github.com/gofrs/uuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
@@ -17,21 +17,17 @@ const (
 	peerTrackClosedId          = "CLOSED"
 	peerTrackConnectionTimeout = 10 * time.Second
 	peerTrackReadTimeout       = 3 * time.Second
-	rtpBufferSize              = 65536
+	packetCacheSize            = 1024
+	rtpReadQueueSize           = 1024
 	rtpClockRate               = 48000
 	rtpPacketSequenceMax       = ^uint16(0)
-	rtpPacketExpiration        = rtpClockRate / 2
+	jitterDrainInterval        = 10 * time.Millisecond
 )
 
 type Sender struct {
-	id  string
-	rtp *webrtc.RTPSender
-}
-
-type NackRequest struct {
-	uid  string
-	cid  string
-	pair *rtcp.NackPair
+	id    string
+	rtp   *webrtc.RTPSender
+	stats receiverStats
 }
 
 type Peer struct {
@@ -40,15 +36,11 @@ type Peer struct {
 	uid         string
 	cid         string
 	pc          *webrtc.PeerConnection
-	track       *webrtc.Track
+	engine      *Engine
+	log         *logx.Logger
+	tracks      map[uint32]*trackCtx
 	publishers  map[string]*Sender
 	subscribers map[string]*Sender
-	buffer      [rtpBufferSize]*rtp.Packet
-	lost        chan *rtp.Header
-	queue       chan *rtp.Packet
-	nack        chan *NackRequest
-	timestamp   uint32
-	sequence    uint16
 	connected   chan bool
 }
 
@@ -57,29 +49,24 @@ func (engine *Engine) BuildPeer(rid, uid string, pc *webrtc.PeerConnection) *Pee
 	if err != nil {
 		panic(err)
 	}
-	peer := &Peer{rid: rid, uid: uid, cid: cid.String(), pc: pc}
+	peer := &Peer{rid: rid, uid: uid, cid: cid.String(), pc: pc, engine: engine}
+	peer.log = engine.logger().With("rid", rid, "uid", uid, "cid", peer.cid)
 	peer.connected = make(chan bool, 1)
-	peer.lost = make(chan *rtp.Header, 17)
-	peer.queue = make(chan *rtp.Packet, 48000)
-	peer.nack = make(chan *NackRequest, 48000)
+	peer.tracks = make(map[uint32]*trackCtx)
 	peer.publishers = make(map[string]*Sender)
 	peer.subscribers = make(map[string]*Sender)
 	peer.handle()
 	return peer
 }
 
-func (p *Peer) id() string {
-	return fmt.Sprintf("%s:%s:%s", p.rid, p.uid, p.cid)
-}
-
 func (p *Peer) Close() error {
-	logger.Printf("PeerClose(%s) now\n", p.id())
+	p.log.Info("PeerClose now")
 	p.Lock()
-	p.track = nil
+	p.tracks = nil
 	p.cid = peerTrackClosedId
 	err := p.pc.Close()
 	p.Unlock()
-	logger.Printf("PeerClose(%s) with %v\n", p.id(), err)
+	p.log.Info("PeerClose done", "error", err)
 	return err
 }
 
@@ -88,42 +75,60 @@ func (peer *Peer) handle() {
 		select {
 		case <-peer.connected:
 		case <-time.After(peerTrackConnectionTimeout):
-			logger.Printf("HandlePeer(%s) OnTrackTimeout()\n", peer.id())
+			peer.log.Warn("OnTrackTimeout")
 			peer.Close()
 		}
 	}()
 
 	peer.pc.OnSignalingStateChange(func(state webrtc.SignalingState) {
-		logger.Printf("HandlePeer(%s) OnSignalingStateChange(%s)\n", peer.id(), state)
+		peer.log.Debug("OnSignalingStateChange", "state", state)
 	})
 	peer.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		logger.Printf("HandlePeer(%s) OnConnectionStateChange(%s)\n", peer.id(), state)
+		peer.log.Debug("OnConnectionStateChange", "state", state)
 	})
 	peer.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		logger.Printf("HandlePeer(%s) OnICEConnectionStateChange(%s)\n", peer.id(), state)
+		peer.log.Debug("OnICEConnectionStateChange", "state", state)
 	})
 	peer.pc.OnTrack(func(rt *webrtc.Track, receiver *webrtc.RTPReceiver) {
-		logger.Printf("HandlePeer(%s) OnTrack(%d, %d)\n", peer.id(), rt.PayloadType(), rt.SSRC())
-		if peer.track != nil || webrtc.DefaultPayloadTypeOpus != rt.PayloadType() {
+		log := peer.log.With("ssrc", rt.SSRC())
+		log.Debug("OnTrack", "payloadType", rt.PayloadType())
+		ci, ok := peer.engine.codec(rt.PayloadType())
+		if !ok {
+			log.Warn("OnTrack codec not registered", "payloadType", rt.PayloadType())
 			return
 		}
-		peer.connected <- true
 
 		peer.Lock()
+		if _, dup := peer.tracks[rt.SSRC()]; dup || peer.cid == peerTrackClosedId {
+			peer.Unlock()
+			return
+		}
 		lt, err := peer.pc.NewTrack(rt.PayloadType(), rt.SSRC(), peer.cid, peer.uid)
 		if err != nil {
 			panic(err)
 		}
-		peer.track = lt
+		tc := newTrackCtx(rt.PayloadType(), ci.clockRate, ci.kind, lt, log)
+		peer.tracks[rt.SSRC()] = tc
+		first := len(peer.tracks) == 1
 		peer.Unlock()
+		if first {
+			peer.connected <- true
+		}
+
+		err = peer.copyTrack(tc, rt, lt)
+		log.Info("OnTrack end", "error", err)
 
-		err = peer.copyTrack(rt, lt)
-		logger.Printf("HandlePeer(%s) OnTrack(%d, %d) end with %s\n", peer.id(), rt.PayloadType(), rt.SSRC(), err.Error())
-		peer.Close()
+		peer.Lock()
+		delete(peer.tracks, rt.SSRC())
+		remaining := len(peer.tracks)
+		peer.Unlock()
+		if remaining == 0 {
+			peer.Close()
+		}
 	})
 }
 
-func (peer *Peer) copyTrack(src, dst *webrtc.Track) error {
+func (peer *Peer) copyTrack(tc *trackCtx, src, dst *webrtc.Track) error {
 	go func() error {
 		for {
 			pkt, err := src.ReadRTP()
@@ -133,18 +138,33 @@ func (peer *Peer) copyTrack(src, dst *webrtc.Track) error {
 			if err != nil {
 				return err
 			}
-			peer.queue <- pkt
+			tc.queue <- pkt
 		}
 	}()
 
 	go func() error {
-		ticker := time.NewTicker(rtpPacketExpiration / 4)
+		ticker := time.NewTicker(jitterDrainInterval)
+		defer ticker.Stop()
+
+		for peer.hasTrack(tc.ssrc) {
+			<-ticker.C
+			for _, pkt := range tc.jit.Drain(tc.arrivalClock()) {
+				if err := peer.playout(tc, dst, pkt); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}()
+
+	go func() error {
+		ticker := time.NewTicker(time.Duration(tc.packetExpiration() / 4))
 		defer ticker.Stop()
 
 		lost := make([]*rtp.Header, 0)
-		for track := peer.track; track != nil; {
+		for peer.hasTrack(tc.ssrc) {
 			select {
-			case p := <-peer.lost:
+			case p := <-tc.lost:
 				lost = append(lost, p)
 			case <-ticker.C:
 			}
@@ -152,7 +172,7 @@ func (peer *Peer) copyTrack(src, dst *webrtc.Track) error {
 				continue
 			}
 			fsn := lost[0]
-			if len(lost) < 16 && fsn.Timestamp+rtpPacketExpiration/4 > peer.timestamp {
+			if len(lost) < 16 && fsn.Timestamp+tc.packetExpiration()/4 > tc.timestamp {
 				continue
 			}
 			blp := uint16(0)
@@ -169,6 +189,7 @@ func (peer *Peer) copyTrack(src, dst *webrtc.Track) error {
 				MediaSSRC:  fsn.SSRC,
 				Nacks:      []rtcp.NackPair{pair},
 			}
+			tc.log.Trace("RequestRetransmit", "seq", pair.PacketID)
 			err := peer.pc.WriteRTCP([]rtcp.Packet{pkt})
 			if err != nil {
 				return err
@@ -181,10 +202,8 @@ func (peer *Peer) copyTrack(src, dst *webrtc.Track) error {
 	for {
 		timer := time.NewTimer(peerTrackReadTimeout)
 		select {
-		case r := <-peer.nack:
-			peer.handleNack(r)
-		case pkt := <-peer.queue:
-			peer.handlePacket(dst, pkt)
+		case pkt := <-tc.queue:
+			peer.handlePacket(tc, dst, pkt)
 		case <-timer.C:
 			return fmt.Errorf("peer track read timeout")
 		}
@@ -192,11 +211,21 @@ func (peer *Peer) copyTrack(src, dst *webrtc.Track) error {
 	}
 }
 
+// hasTrack reports whether ssrc is still an active track of peer, so the
+// background goroutines spawned by copyTrack know when to stop.
+func (peer *Peer) hasTrack(ssrc uint32) bool {
+	peer.RLock()
+	defer peer.RUnlock()
+	_, ok := peer.tracks[ssrc]
+	return ok
+}
+
 func (peer *Peer) LoopRTCP(uid string, sender *Sender) error {
+	log := peer.log.With("uid", uid, "cid", sender.id)
 	for {
 		pkts, err := sender.rtp.ReadRTCP()
 		if err != nil {
-			logger.Printf("LoopRTCP(%s,%s,%s) with %v\n", peer.id(), uid, sender.id, err)
+			log.Warn("LoopRTCP ReadRTCP failed", "error", err)
 			return err
 		}
 		for _, pkt := range pkts {
@@ -204,8 +233,26 @@ func (peer *Peer) LoopRTCP(uid string, sender *Sender) error {
 			case *rtcp.TransportLayerNack:
 				nack := pkt.(*rtcp.TransportLayerNack)
 				for _, pair := range nack.Nacks {
-					logger.Verbosef("LoopRTCP(%s,%s,%s) TransportLayerNack %v\n", peer.id(), uid, sender.id, pair.PacketList())
-					peer.nack <- &NackRequest{uid: uid, cid: sender.id, pair: &pair}
+					log.Trace("TransportLayerNack", "ssrc", nack.MediaSSRC, "seq", pair.PacketList())
+					peer.handleNack(sender, nack.MediaSSRC, &pair)
+				}
+			case *rtcp.ReceiverReport:
+				rr := pkt.(*rtcp.ReceiverReport)
+				for i := range rr.Reports {
+					log.Trace("ReceiverReport", "ssrc", rr.Reports[i].SSRC, "fractionLost", rr.Reports[i].FractionLost, "jitter", rr.Reports[i].Jitter)
+					sender.stats.update(&rr.Reports[i])
+				}
+			case *rtcp.PictureLossIndication:
+				pli := pkt.(*rtcp.PictureLossIndication)
+				log.Debug("PictureLossIndication", "ssrc", pli.MediaSSRC)
+				if err := peer.pc.WriteRTCP([]rtcp.Packet{pli}); err != nil {
+					log.Warn("PictureLossIndication forward failed", "error", err)
+				}
+			case *rtcp.FullIntraRequest:
+				fir := pkt.(*rtcp.FullIntraRequest)
+				log.Debug("FullIntraRequest", "fir", fir.FIR)
+				if err := peer.pc.WriteRTCP([]rtcp.Packet{fir}); err != nil {
+					log.Warn("FullIntraRequest forward failed", "error", err)
 				}
 			default:
 			}
@@ -213,37 +260,56 @@ func (peer *Peer) LoopRTCP(uid string, sender *Sender) error {
 	}
 }
 
-func (peer *Peer) handlePacket(dst *webrtc.Track, pkt *rtp.Packet) error {
-	old := peer.buffer[pkt.SequenceNumber]
-	if old != nil && old.Timestamp >= pkt.Timestamp {
-		return nil
-	}
-	if peer.timestamp > pkt.Timestamp+rtpPacketExpiration {
-		return nil
+// handlePacket admits pkt into tc's jitter buffer and writes out whatever
+// the buffer releases as ready, in sequence order. The buffer absorbs
+// reordering and deduplicates true duplicates on its own, so this no
+// longer needs to special-case tc.timestamp == pkt.Timestamp.
+func (peer *Peer) handlePacket(tc *trackCtx, dst *webrtc.Track, pkt *rtp.Packet) error {
+	now := tc.arrivalClock()
+	for _, ready := range tc.jit.Push(pkt, now, now) {
+		if err := peer.playout(tc, dst, ready); err != nil {
+			return err
+		}
 	}
-	if peer.timestamp == pkt.Timestamp {
-		return nil
+	return nil
+}
+
+// playout forwards a packet released by tc's jitter buffer, requesting
+// retransmission for any sequence gap it reveals before updating tc's
+// last-seen position.
+func (peer *Peer) playout(tc *trackCtx, dst *webrtc.Track, pkt *rtp.Packet) error {
+	if tc.timestamp != 0 && pkt.Timestamp > tc.timestamp {
+		peer.handleLost(tc, pkt)
 	}
-	if pkt.Timestamp > peer.timestamp {
-		peer.handleLost(pkt)
-		peer.timestamp = pkt.Timestamp
-		peer.sequence = pkt.SequenceNumber
+	tc.timestamp = pkt.Timestamp
+	tc.sequence = pkt.SequenceNumber
+
+	tc.rate.Update(len(pkt.Payload), tc.arrivalClock())
+	if err := tc.cache.Store(pkt); err != nil {
+		tc.log.Warn("Playout cache.Store failed", "seq", pkt.SequenceNumber, "error", err)
 	}
-	peer.buffer[pkt.SequenceNumber] = pkt
+	tc.fanout(pkt)
 	return dst.WriteRTP(pkt)
 }
 
-func (peer *Peer) handleLost(pkt *rtp.Packet) error {
-	gap := pkt.SequenceNumber - peer.sequence
-	if pkt.SequenceNumber < peer.sequence {
-		gap = rtpPacketSequenceMax - peer.sequence + pkt.SequenceNumber + 1
+// handleLost queues retransmission requests for the sequence gap pkt just
+// revealed. Audio tracks skip this entirely: by the time a NACK round-trips
+// the lost sample is already past its playout deadline, so chasing it only
+// spends bandwidth a video keyframe request would spend more usefully.
+func (peer *Peer) handleLost(tc *trackCtx, pkt *rtp.Packet) error {
+	if tc.kind == webrtc.RTPCodecTypeAudio {
+		return nil
 	}
-	if peer.timestamp+rtpPacketExpiration/2 < pkt.Timestamp {
+	gap := pkt.SequenceNumber - tc.sequence
+	if pkt.SequenceNumber < tc.sequence {
+		gap = rtpPacketSequenceMax - tc.sequence + pkt.SequenceNumber + 1
+	}
+	if tc.timestamp+tc.packetExpiration()/2 < pkt.Timestamp {
 		return nil
 	}
-	next := (uint32(peer.sequence) + 1) % 65536
+	next := (uint32(tc.sequence) + 1) % 65536
 	if gap > 17 {
-		next = (uint32(peer.sequence) + uint32(gap-17)) % 65536
+		next = (uint32(tc.sequence) + uint32(gap-17)) % 65536
 		gap = 17
 	}
 	if next+uint32(gap) > 65536 {
@@ -251,9 +317,9 @@ func (peer *Peer) handleLost(pkt *rtp.Packet) error {
 		next = 0
 	}
 	for i := uint16(1); i < gap; i++ {
-		peer.lost <- &rtp.Header{
+		tc.lost <- &rtp.Header{
 			SequenceNumber: uint16(next),
-			Timestamp:      peer.timestamp,
+			Timestamp:      tc.timestamp,
 			SSRC:           pkt.SSRC,
 		}
 		next = next + 1
@@ -261,25 +327,32 @@ func (peer *Peer) handleLost(pkt *rtp.Packet) error {
 	return nil
 }
 
-func (peer *Peer) handleNack(r *NackRequest) error {
+// handleNack resends the packets sender asked for by ssrc's NACK pair. It
+// runs on sender's own LoopRTCP goroutine, so one subscriber flooding NACKs
+// only ever serializes against itself, never against any other subscriber.
+func (peer *Peer) handleNack(sender *Sender, ssrc uint32, pair *rtcp.NackPair) error {
+	if sender.stats.overloaded() {
+		peer.log.Trace("HandleNack skipped, subscriber already lossy", "cid", sender.id)
+		return nil
+	}
+
 	peer.RLock()
-	sender := peer.subscribers[r.uid]
+	tc := peer.tracks[ssrc]
 	peer.RUnlock()
-
-	if sender == nil || sender.id != r.cid {
+	if tc == nil {
 		return nil
 	}
 
-	for _, seq := range r.pair.PacketList() {
-		pkt := peer.buffer[seq]
+	for _, seq := range pair.PacketList() {
+		pkt := tc.cache.GetPacket(seq)
 		if pkt == nil {
 			continue
 		}
-		if peer.timestamp > pkt.Timestamp+rtpPacketExpiration {
+		if tc.timestamp > pkt.Timestamp+tc.packetExpiration() {
 			continue
 		}
 		i, err := sender.rtp.SendRTP(&pkt.Header, pkt.Payload)
-		logger.Verbosef("HandleNack(%s,%s,%s,%d) with %d %v\n", peer.id(), r.uid, r.cid, seq, i, err)
+		tc.log.Trace("HandleNack resend", "cid", sender.id, "seq", seq, "sent", i, "error", err)
 	}
 	return nil
 }
@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// nackLossBackoff is the fraction-lost threshold, on the 0-255 RTCP scale,
+// above which handleNack stops resending to a subscriber so a bad link
+// doesn't get more packets piled onto it.
+const nackLossBackoff = 256 / 10 // 10%
+
+// receiverStats holds the most recent RTCP receiver-report fields for a
+// single subscriber. Fields are updated from LoopRTCP and read from the
+// packet-forwarding path, so all access goes through atomics rather than
+// the Peer lock.
+type receiverStats struct {
+	fractionLost uint32
+	jitter       uint32
+	jiffies      uint32
+	rttJiffies   uint32
+}
+
+func (s *receiverStats) update(rr *rtcp.ReceptionReport) {
+	atomic.StoreUint32(&s.fractionLost, uint32(rr.FractionLost))
+	atomic.StoreUint32(&s.jitter, rr.Jitter)
+	atomic.StoreUint32(&s.jiffies, rr.LastSenderReport)
+
+	if rr.LastSenderReport != 0 {
+		now := ntpShortFormat(time.Now())
+		if rtt := int64(now) - int64(rr.LastSenderReport) - int64(rr.Delay); rtt > 0 {
+			atomic.StoreUint32(&s.rttJiffies, uint32(rtt))
+		}
+	}
+}
+
+// rtt returns the most recent round-trip estimate derived from the LSR/DLSR
+// fields of a receiver report, per RFC 3550 A.8.
+func (s *receiverStats) rtt() time.Duration {
+	jiffies := atomic.LoadUint32(&s.rttJiffies)
+	return time.Duration(jiffies) * time.Second / (1 << 16)
+}
+
+// ntpShortFormat converts t to the 32-bit "middle 32 bits of the NTP
+// timestamp" format RTCP SR/RR fields use.
+func ntpShortFormat(t time.Time) uint32 {
+	secs := uint32(t.Unix() + 2208988800) // NTP epoch is 1900, Unix is 1970
+	frac := uint32(uint64(t.Nanosecond()) * (1 << 16) / 1e9)
+	return secs<<16 | frac&0xffff
+}
+
+// overloaded reports whether the subscriber's last known loss fraction is
+// already above nackLossBackoff, in which case new NACK resends would only
+// add to the congestion.
+func (s *receiverStats) overloaded() bool {
+	return atomic.LoadUint32(&s.fractionLost) > nackLossBackoff
+}
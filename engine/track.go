@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/kraken/engine/jitter"
+	"github.com/MixinNetwork/kraken/engine/logx"
+	"github.com/MixinNetwork/kraken/engine/packetcache"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+// trackCtx holds everything copyTrack and its helpers need to forward one
+// published track, keyed by its SSRC on the owning Peer. A publisher that
+// sends simultaneous audio and video ends up with one trackCtx per track
+// instead of the single hard-coded Opus track Peer used to assume.
+type trackCtx struct {
+	ssrc        uint32
+	payloadType uint8
+	clockRate   uint32
+	kind        webrtc.RTPCodecType
+
+	track *webrtc.Track
+	cache *packetcache.Cache
+	rate  *packetcache.Estimator
+	jit   *jitter.Buffer
+	start time.Time
+	log   *logx.Logger
+
+	lost  chan *rtp.Header
+	queue chan *rtp.Packet
+
+	subsLock sync.RWMutex
+	subs     map[string]*subscriberQueue
+
+	timestamp uint32
+	sequence  uint16
+}
+
+func newTrackCtx(payloadType uint8, clockRate uint32, kind webrtc.RTPCodecType, track *webrtc.Track, log *logx.Logger) *trackCtx {
+	return &trackCtx{
+		ssrc:        track.SSRC(),
+		payloadType: payloadType,
+		clockRate:   clockRate,
+		kind:        kind,
+		track:       track,
+		cache:       packetcache.New(packetCacheSize),
+		rate:        packetcache.NewEstimator(clockRate),
+		jit:         jitter.New(clockRate),
+		start:       time.Now(),
+		log:         log,
+		lost:        make(chan *rtp.Header, 17),
+		queue:       make(chan *rtp.Packet, rtpReadQueueSize),
+		subs:        make(map[string]*subscriberQueue),
+	}
+}
+
+// arrivalClock returns the current time expressed in this track's RTP
+// timestamp units, relative to when the track was first seen.
+func (tc *trackCtx) arrivalClock() uint32 {
+	return uint32(time.Since(tc.start) * time.Duration(tc.clockRate) / time.Second)
+}
+
+// packetExpiration is how long, in this track's own RTP timestamp units,
+// a packet is considered worth chasing with a NACK before it's given up
+// on. It scales with clockRate so a 90kHz video track gets the same real
+// time window as the 48kHz audio case this was originally sized for.
+func (tc *trackCtx) packetExpiration() uint32 {
+	return tc.clockRate / 2
+}